@@ -0,0 +1,148 @@
+//
+// This file handles the multi-account config file (--config), which
+// replaced the single --host/--user/--mailbox flags. Each account can list
+// several mailboxes (e.g. Spam, Trash, Junk on one Gmail account); each
+// (account, mailbox) pair becomes a Job that's monitored independently.
+//
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AccountConfig describes one IMAP account to monitor, and the mailboxes
+// within it to watch.
+type AccountConfig struct {
+	Name         string   `yaml:"name"`
+	Host         string   `yaml:"host"`
+	Port         int      `yaml:"port"`
+	User         string   `yaml:"user"`
+	PasswordFile string   `yaml:"password_file"`
+	Mailboxes    []string `yaml:"mailboxes"`
+}
+
+// AccountsConfig is the top-level shape of the --config file.
+type AccountsConfig struct {
+	Accounts []AccountConfig `yaml:"accounts"`
+}
+
+// Job is a single (account, mailbox) pair to monitor. It's the unit of work
+// handed to a worker goroutine.
+type Job struct {
+	Account string
+	Host    string
+	Port    int
+	User    string
+	Mailbox string
+
+	passwordFile string
+}
+
+// loadAccountsConfig reads and validates the --config file.
+func loadAccountsConfig(path string) (*AccountsConfig, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("You must provide a --config file.")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s", err)
+	}
+
+	config := &AccountsConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file: %s", err)
+	}
+
+	if len(config.Accounts) == 0 {
+		return nil, fmt.Errorf("Config file has no accounts.")
+	}
+
+	for i, account := range config.Accounts {
+		if len(account.Name) == 0 {
+			return nil, fmt.Errorf("Account %d has no name.", i)
+		}
+		if len(account.Host) == 0 {
+			return nil, fmt.Errorf("Account %s has no host.", account.Name)
+		}
+		if len(account.User) == 0 {
+			return nil, fmt.Errorf("Account %s has no user.", account.Name)
+		}
+		if len(account.PasswordFile) == 0 {
+			return nil, fmt.Errorf("Account %s has no password_file.", account.Name)
+		}
+		if len(account.Mailboxes) == 0 {
+			return nil, fmt.Errorf("Account %s has no mailboxes.", account.Name)
+		}
+		if config.Accounts[i].Port == 0 {
+			config.Accounts[i].Port = 993
+		}
+	}
+
+	return config, nil
+}
+
+// buildJobs expands each account's mailboxes into Jobs, optionally filtered
+// down to a single account by --only.
+func buildJobs(config *AccountsConfig, only string) ([]Job, error) {
+	var jobs []Job
+
+	for _, account := range config.Accounts {
+		if len(only) > 0 && account.Name != only {
+			continue
+		}
+
+		for _, mailbox := range account.Mailboxes {
+			jobs = append(jobs, Job{
+				Account:      account.Name,
+				Host:         account.Host,
+				Port:         account.Port,
+				User:         account.User,
+				Mailbox:      mailbox,
+				passwordFile: account.PasswordFile,
+			})
+		}
+	}
+
+	if len(jobs) == 0 {
+		if len(only) > 0 {
+			return nil, fmt.Errorf("No account named %s found in config.", only)
+		}
+		return nil, fmt.Errorf("No mailboxes to monitor.")
+	}
+
+	return jobs, nil
+}
+
+// passwordCache reads each account's password file at most once, since
+// several Jobs (one per mailbox) typically share the same account.
+type passwordCache struct {
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newPasswordCache() *passwordCache {
+	return &passwordCache{cache: map[string]string{}}
+}
+
+func (c *passwordCache) get(path string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pass, ok := c.cache[path]; ok {
+		return pass, nil
+	}
+
+	pass, err := readFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.cache[path] = pass
+
+	return pass, nil
+}
@@ -0,0 +1,133 @@
+//
+// This file implements --fetch-body: fetching BODY.PEEK[HEADER] and
+// BODY.PEEK[TEXT] (PEEK so we never set \Seen on a mailbox we're only
+// reviewing) and parsing the result with go-message/mail to produce a
+// plaintext preview and an attachment manifest.
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+
+	// Registers additional charsets (ISO-8859-1, Windows-1252, etc.) with
+	// go-message so non-UTF-8 parts decode cleanly instead of erroring out.
+	_ "github.com/emersion/go-message/charset"
+)
+
+// defaultBodyPreviewBytes is used when --body-preview-bytes isn't given.
+const defaultBodyPreviewBytes = 1024
+
+// headerBodySection and textBodySection are the two PEEK sections we fetch
+// when --fetch-body is given.
+var headerBodySection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+var textBodySection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier},
+	Peek:         true,
+}
+
+// bodyFetchItems are the extra FETCH items to request when --fetch-body is
+// given, in addition to ENVELOPE/INTERNALDATE.
+func bodyFetchItems() []string {
+	return []string{headerBodySection.FetchItem(), textBodySection.FetchItem()}
+}
+
+// parseMessageBody extracts a plaintext preview (capped at previewBytes) and
+// an attachment manifest from a message's raw header and text sections. It
+// handles multipart/alternative, quoted-printable, base64, and non-UTF-8
+// encodings via go-message/mail.
+func parseMessageBody(header, text io.Reader, previewBytes int) (string,
+	[]Attachment, error) {
+
+	headerBytes, err := ioutil.ReadAll(header)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to read header: %s", err)
+	}
+
+	textBytes, err := ioutil.ReadAll(text)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to read body: %s", err)
+	}
+
+	raw := bytes.NewBuffer(headerBytes)
+	raw.Write(textBytes)
+
+	mr, err := mail.CreateReader(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse message: %s", err)
+	}
+
+	var preview string
+	var attachments []Attachment
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("Unable to read message part: %s", err)
+		}
+
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			if len(preview) > 0 {
+				continue
+			}
+
+			contentType, _, _ := h.ContentType()
+			if contentType != "text/plain" && contentType != "" {
+				continue
+			}
+
+			body, err := ioutil.ReadAll(io.LimitReader(part.Body, int64(previewBytes)+1))
+			if err != nil {
+				return "", nil, fmt.Errorf("Unable to read inline part: %s", err)
+			}
+
+			preview = truncatePreview(string(body), previewBytes)
+
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			contentType, _, _ := h.ContentType()
+
+			size, err := io.Copy(ioutil.Discard, part.Body)
+			if err != nil {
+				return "", nil, fmt.Errorf("Unable to read attachment: %s", err)
+			}
+
+			attachments = append(attachments, Attachment{
+				Filename:    filename,
+				ContentType: contentType,
+				Size:        size,
+			})
+		}
+	}
+
+	return preview, attachments, nil
+}
+
+// truncatePreview caps s at n bytes without splitting a UTF-8 rune.
+func truncatePreview(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	s = s[:n]
+
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+
+	return s
+}
@@ -0,0 +1,148 @@
+//
+// This file is the bolt Store backend: a dependency-light, single-file
+// option for installs that don't want sqlite's cgo-free but still
+// SQL-shaped footprint either. It only implements the Store interface, not
+// sqlStore, so the default incremental --search falls back to a full fetch on
+// every run, and --watch to a full fetch on every (re)connect and every
+// mailbox update; see the notes in watch.go/search.go.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltMessagesBucket = []byte("imap_notify")
+
+type boltRecord struct {
+	Account      string       `json:"account"`
+	MessageID    string       `json:"message_id"`
+	Subject      string       `json:"subject"`
+	From         []string     `json:"from"`
+	InternalDate time.Time    `json:"internal_date"`
+	CreateTime   time.Time    `json:"create_time"`
+	BodyPreview  string       `json:"body_preview"`
+	Attachments  []Attachment `json:"attachments"`
+}
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (Store, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("bolt --store DSN must include a path, e.g. bolt:///path/to/db.bolt")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open bolt database: %s", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMessagesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("Unable to create bolt bucket: %s", err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltKey identifies a message the same way the SQL backends' unique index
+// does: by account, message-id, and internal date, since message ids aren't
+// guaranteed unique across accounts.
+func boltKey(account, messageID string, internalDate time.Time) []byte {
+	return []byte(strings.Join([]string{account, messageID,
+		strconv.FormatInt(internalDate.Unix(), 10)}, "\x00"))
+}
+
+func (s *boltStore) Seen(account, messageID string, internalDate time.Time) (bool, error) {
+	var seen bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltMessagesBucket)
+		seen = bucket.Get(boltKey(account, messageID, internalDate)) != nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Unable to query bolt database: %s", err)
+	}
+
+	return seen, nil
+}
+
+func (s *boltStore) Record(message *Message) error {
+	record := &boltRecord{
+		Account:      message.Account,
+		MessageID:    message.MessageID,
+		Subject:      message.Subject,
+		From:         message.From,
+		InternalDate: message.InternalDate,
+		CreateTime:   time.Now(),
+		BodyPreview:  message.BodyPreview,
+		Attachments:  message.Attachments,
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal record: %s", err)
+	}
+
+	key := boltKey(message.Account, message.MessageID, message.InternalDate)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltMessagesBucket)
+		if err := bucket.Put(key, raw); err != nil {
+			return fmt.Errorf("Unable to store record: %s", err)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Prune(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltMessagesBucket)
+
+		var staleKeys [][]byte
+
+		err := bucket.ForEach(func(key, raw []byte) error {
+			record := &boltRecord{}
+			if err := json.Unmarshal(raw, record); err != nil {
+				return fmt.Errorf("Unable to unmarshal record: %s", err)
+			}
+
+			if record.CreateTime.Before(cutoff) {
+				// Don't modify the bucket while iterating it; collect keys first.
+				staleKeys = append(staleKeys, append([]byte{}, key...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range staleKeys {
+			if err := bucket.Delete(key); err != nil {
+				return fmt.Errorf("Unable to delete record: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,87 @@
+//
+// This file handles loading the notifier config file. Most notifiers need
+// more settings than comfortably fit as flags (SMTP credentials, webhook
+// URLs, API tokens), so those live in a small YAML file selected with
+// --notifier-config instead.
+//
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NotifierConfig holds the settings for every notifier that needs more than
+// a name to configure. stdout and desktop aren't represented here since
+// they take no settings.
+type NotifierConfig struct {
+	SMTP     *SMTPConfig     `yaml:"smtp"`
+	Webhook  *WebhookConfig  `yaml:"webhook"`
+	Pushover *PushoverConfig `yaml:"pushover"`
+}
+
+// loadNotifierConfig reads and parses the notifier config file. An empty
+// path is fine as long as none of the selected notifiers need configuration
+// (e.g. --notifier stdout).
+func loadNotifierConfig(path string) (*NotifierConfig, error) {
+	if len(path) == 0 {
+		return &NotifierConfig{}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s", err)
+	}
+
+	config := &NotifierConfig{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file: %s", err)
+	}
+
+	return config, nil
+}
+
+// buildNotifiers turns the --notifier names into Notifiers, pulling any
+// settings they need out of config.
+func buildNotifiers(names []string, config *NotifierConfig) (Notifier, error) {
+	var notifiers []Notifier
+
+	for _, name := range names {
+		switch name {
+		case "stdout":
+			notifiers = append(notifiers, newStdoutNotifier())
+
+		case "desktop":
+			notifiers = append(notifiers, newDesktopNotifier())
+
+		case "smtp":
+			if config.SMTP == nil {
+				return nil, fmt.Errorf("--notifier smtp requires an smtp section in the config file")
+			}
+			notifiers = append(notifiers, newSMTPNotifier(config.SMTP))
+
+		case "webhook":
+			if config.Webhook == nil {
+				return nil, fmt.Errorf("--notifier webhook requires a webhook section in the config file")
+			}
+			notifiers = append(notifiers, newWebhookNotifier(config.Webhook))
+
+		case "pushover":
+			if config.Pushover == nil {
+				return nil, fmt.Errorf("--notifier pushover requires a pushover section in the config file")
+			}
+			notifiers = append(notifiers, newPushoverNotifier(config.Pushover))
+
+		default:
+			return nil, fmt.Errorf("Unknown notifier: %s", name)
+		}
+	}
+
+	if len(notifiers) == 0 {
+		notifiers = append(notifiers, newStdoutNotifier())
+	}
+
+	return newMultiNotifier(notifiers), nil
+}
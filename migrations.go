@@ -0,0 +1,66 @@
+//
+// A minimal migration runner so schema changes ship with the binary instead
+// of being applied out of band. Used by every Store backend built on
+// database/sql (sqlite, postgres); each migration is tracked by index in
+// schema_migrations so that re-running against an already-migrated database
+// is a no-op.
+//
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// runMigrations applies any of migrations not yet recorded in
+// schema_migrations, in order. versionPlaceholder is the driver's
+// placeholder syntax for the version bind parameter ("?" for sqlite, "$1"
+// for postgres).
+func runMigrations(db *sql.DB, migrations []string, versionPlaceholder string) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY
+	)
+	`)
+	if err != nil {
+		return fmt.Errorf("Unable to create schema_migrations table: %s", err)
+	}
+
+	applied := map[int]bool{}
+
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("Unable to query schema_migrations: %s", err)
+	}
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("Unable to scan schema_migrations row: %s", err)
+		}
+		applied[version] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Problem reading schema_migrations: %s", err)
+	}
+
+	for version, migration := range migrations {
+		if applied[version] {
+			continue
+		}
+
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("Unable to apply migration %d: %s", version, err)
+		}
+
+		query := fmt.Sprintf(`INSERT INTO schema_migrations (version) VALUES (%s)`,
+			versionPlaceholder)
+		if _, err := db.Exec(query, version); err != nil {
+			return fmt.Errorf("Unable to record migration %d: %s", version, err)
+		}
+	}
+
+	return nil
+}
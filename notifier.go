@@ -0,0 +1,297 @@
+//
+// This file defines the Notifier interface and the set of notifier
+// implementations we ship. Deduplication is handled upstream of here: by the
+// time a Notifier sees a Message, storeAndReportMessages has already
+// confirmed it's not in the database. A message is only recorded after Notify
+// succeeds, so one whose delivery (or recording) failed is notified again on
+// the next run.
+//
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+
+	"github.com/gen2brain/beeep"
+	"golang.org/x/net/html/charset"
+)
+
+// Notifier delivers a single message notification. Implementations should
+// not assume Notify is only ever called once per message; the interesting
+// dedup work happens before a Notifier is ever invoked.
+type Notifier interface {
+	Notify(ctx context.Context, message *Message) error
+}
+
+// multiNotifier fans a notification out to several Notifiers, continuing on
+// to the rest even if one fails, and returning a combined error.
+type multiNotifier struct {
+	notifiers []Notifier
+}
+
+// newMultiNotifier builds a Notifier that notifies each of notifiers in
+// turn.
+func newMultiNotifier(notifiers []Notifier) Notifier {
+	return &multiNotifier{notifiers: notifiers}
+}
+
+func (n *multiNotifier) Notify(ctx context.Context, message *Message) error {
+	var errs []string
+
+	for _, notifier := range n.notifiers {
+		if err := notifier.Notify(ctx, message); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d notifiers failed: %s",
+			len(errs), len(n.notifiers), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// decodedSubjectAndFrom returns the MIME word decoded subject and from
+// addresses for a message, falling back to the raw value if decoding fails.
+func decodedSubjectAndFrom(message *Message) (string, []string) {
+	decoder := &mime.WordDecoder{
+		CharsetReader: charset.NewReaderLabel,
+	}
+
+	subject, err := decoder.DecodeHeader(message.Subject)
+	if err != nil {
+		subject = message.Subject
+	}
+
+	from := make([]string, len(message.From))
+	for i, fromHeader := range message.From {
+		decoded, err := decoder.DecodeHeader(fromHeader)
+		if err != nil {
+			decoded = fromHeader
+		}
+		from[i] = decoded
+	}
+
+	return subject, from
+}
+
+// summaryText renders a short human-readable summary of a message,
+// including its body preview and attachment manifest when --fetch-body
+// populated them. Notifiers that can only carry plain text (smtp, pushover,
+// desktop) use this instead of building their own.
+func summaryText(message *Message) string {
+	subject, from := decodedSubjectAndFrom(message)
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s\nFrom: %s", subject, strings.Join(from, ", "))
+
+	if len(message.BodyPreview) > 0 {
+		fmt.Fprintf(&b, "\n\n%s", message.BodyPreview)
+	}
+
+	for _, attachment := range message.Attachments {
+		fmt.Fprintf(&b, "\nAttachment: %s (%s, %d bytes)", attachment.Filename,
+			attachment.ContentType, attachment.Size)
+	}
+
+	return b.String()
+}
+
+// stdoutNotifier logs a message the same way the tool always has. It's the
+// default, and, like desktop, doesn't require any configuration.
+type stdoutNotifier struct{}
+
+func newStdoutNotifier() Notifier {
+	return &stdoutNotifier{}
+}
+
+func (n *stdoutNotifier) Notify(_ context.Context, message *Message) error {
+	return outputMessage(message)
+}
+
+// SMTPConfig holds the settings needed to forward a notification as an
+// email.
+type SMTPConfig struct {
+	Server string `yaml:"server"`
+	Port   int    `yaml:"port"`
+	User   string `yaml:"user"`
+	Pass   string `yaml:"pass"`
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+}
+
+// smtpNotifier forwards a summary of the message to another address. This is
+// the headless-friendly equivalent of the old log.Printf behaviour: mail
+// sent here lands in your normal inbox rather than a cron log no one reads.
+type smtpNotifier struct {
+	config *SMTPConfig
+}
+
+func newSMTPNotifier(config *SMTPConfig) Notifier {
+	return &smtpNotifier{config: config}
+}
+
+func (n *smtpNotifier) Notify(_ context.Context, message *Message) error {
+	subject, _ := decodedSubjectAndFrom(message)
+
+	body := strings.ReplaceAll(summaryText(message), "\n", "\r\n")
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: imap-notify: %s\r\n\r\n%s",
+		n.config.From, n.config.To, subject, body)
+
+	addr := fmt.Sprintf("%s:%d", n.config.Server, n.config.Port)
+
+	var auth smtp.Auth
+	if len(n.config.User) > 0 {
+		auth = smtp.PlainAuth("", n.config.User, n.config.Pass, n.config.Server)
+	}
+
+	err := smtp.SendMail(addr, auth, n.config.From, []string{n.config.To},
+		[]byte(msg))
+	if err != nil {
+		return fmt.Errorf("Unable to send mail: %s", err)
+	}
+
+	return nil
+}
+
+// WebhookConfig holds the settings needed to POST a notification to a
+// webhook URL (Slack, Discord, Matrix, or anything else that accepts a JSON
+// body).
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+}
+
+type webhookNotifier struct {
+	config *WebhookConfig
+	client *http.Client
+}
+
+func newWebhookNotifier(config *WebhookConfig) Notifier {
+	return &webhookNotifier{
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+type webhookPayload struct {
+	Subject     string       `json:"subject"`
+	From        []string     `json:"from"`
+	Date        string       `json:"date"`
+	BodyPreview string       `json:"body_preview,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, message *Message) error {
+	subject, from := decodedSubjectAndFrom(message)
+
+	payload := webhookPayload{
+		Subject:     subject,
+		From:        from,
+		Date:        message.InternalDate.String(),
+		BodyPreview: message.BodyPreview,
+		Attachments: message.Attachments,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal payload: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to build request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to POST webhook: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// PushoverConfig holds the settings needed to send a Pushover notification.
+type PushoverConfig struct {
+	Token   string `yaml:"token"`
+	UserKey string `yaml:"user_key"`
+}
+
+const pushoverAPIURL = "https://api.pushover.net/1/messages.json"
+
+type pushoverNotifier struct {
+	config *PushoverConfig
+	client *http.Client
+}
+
+func newPushoverNotifier(config *PushoverConfig) Notifier {
+	return &pushoverNotifier{
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+func (n *pushoverNotifier) Notify(ctx context.Context, message *Message) error {
+	form := url.Values{
+		"token":   {n.config.Token},
+		"user":    {n.config.UserKey},
+		"title":   {"imap-notify"},
+		"message": {summaryText(message)},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverAPIURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("Unable to build request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to send Pushover notification: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Pushover returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// desktopNotifier raises a desktop notification via beeep. Useful when
+// running interactively rather than as a cron/systemd job.
+type desktopNotifier struct{}
+
+func newDesktopNotifier() Notifier {
+	return &desktopNotifier{}
+}
+
+func (n *desktopNotifier) Notify(_ context.Context, message *Message) error {
+	err := beeep.Notify("imap-notify", summaryText(message), "")
+	if err != nil {
+		return fmt.Errorf("Unable to raise desktop notification: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+//
+// This file is the original Store backend: the Postgres schema the tool has
+// always used. Like sqlite, its tables (imap_notify, imap_notify_mailbox_state,
+// imap_notify_last_run) are created and migrated by the binary itself on
+// open, via postgresMigrations/runMigrations, rather than out of band.
+//
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS imap_notify (
+		id             SERIAL PRIMARY KEY,
+		account        TEXT NOT NULL DEFAULT '',
+		message_id     TEXT NOT NULL,
+		subject        TEXT NOT NULL DEFAULT '',
+		from_addresses TEXT NOT NULL DEFAULT '',
+		internal_date  TIMESTAMPTZ NOT NULL,
+		create_time    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		body_preview   TEXT NOT NULL DEFAULT '',
+		attachments    JSONB NOT NULL DEFAULT '[]'
+	)`,
+	// An install created before the account column existed needs it before
+	// the index below can be built on it.
+	`ALTER TABLE imap_notify ADD COLUMN IF NOT EXISTS account TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS imap_notify_account_message_id_internal_date
+		ON imap_notify (account, message_id, internal_date)`,
+	`CREATE TABLE IF NOT EXISTS imap_notify_mailbox_state (
+		host         TEXT NOT NULL,
+		"user"       TEXT NOT NULL,
+		mailbox      TEXT NOT NULL,
+		uid_validity BIGINT NOT NULL,
+		uid_next     BIGINT NOT NULL,
+		update_time  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (host, "user", mailbox)
+	)`,
+	`CREATE TABLE IF NOT EXISTS imap_notify_last_run (
+		host        TEXT NOT NULL,
+		"user"      TEXT NOT NULL,
+		mailbox     TEXT NOT NULL,
+		last_run_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (host, "user", mailbox)
+	)`,
+	// Installs created before account/body_preview/attachments existed won't
+	// have these columns; add them if missing rather than requiring a manual
+	// ALTER before upgrading the binary.
+	`ALTER TABLE imap_notify ADD COLUMN IF NOT EXISTS account TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE imap_notify ADD COLUMN IF NOT EXISTS body_preview TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE imap_notify ADD COLUMN IF NOT EXISTS attachments JSONB NOT NULL DEFAULT '[]'`,
+}
+
+// DBMessage holds information about a message already recorded in the
+// Postgres imap_notify table.
+type DBMessage struct {
+	ID            int
+	Account       string
+	MessageID     string
+	Subject       string
+	FromAddresses string
+	InternalDate  time.Time
+	CreateTime    time.Time
+	BodyPreview   string
+	Attachments   string
+}
+
+func (m *DBMessage) String() string {
+	return fmt.Sprintf("ID: %d Account: %s Message-ID: %s Subject: %s Time: %s From: %s Create Time: %s",
+		m.ID, m.Account, m.MessageID, m.Subject, m.InternalDate, m.FromAddresses, m.CreateTime)
+}
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(dsn string) (Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to database: %s", err)
+	}
+
+	if err := runMigrations(db, postgresMigrations, "$1"); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("Unable to migrate postgres database: %s", err)
+	}
+
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) DB() *sql.DB {
+	return s.db
+}
+
+// Placeholder implements sqlStore.
+func (s *postgresStore) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *postgresStore) Seen(account, messageID string,
+	internalDate time.Time) (bool, error) {
+
+	messages, err := dbGetMessage(s.db, account, messageID, internalDate)
+	if err != nil {
+		return false, err
+	}
+
+	if len(messages) > 1 {
+		return false, fmt.Errorf("Multiple matching messages in the database for %s/%s",
+			account, messageID)
+	}
+
+	return len(messages) == 1, nil
+}
+
+func (s *postgresStore) Record(message *Message) error {
+	return dbInsertMessage(s.db, message)
+}
+
+func (s *postgresStore) Prune(olderThan time.Duration) error {
+	query := `DELETE FROM imap_notify WHERE create_time < $1`
+
+	_, err := s.db.Exec(query, time.Now().Add(-olderThan))
+	if err != nil {
+		return fmt.Errorf("Unable to prune: %s", err)
+	}
+
+	return nil
+}
+
+// dbGetMessage looks up previously seen messages. account is included in
+// the comparison, not just message_id/internal_date, since message ids
+// aren't guaranteed unique across different accounts.
+func dbGetMessage(db *sql.DB, account, messageID string,
+	internalDate time.Time) ([]*DBMessage, error) {
+	// Rationale for using internal date: It is possible for message ids to not
+	// be unique (but they should be).
+
+	query := `
+	SELECT id, account, message_id, subject, from_addresses, internal_date, create_time
+	FROM imap_notify
+	WHERE account = $1 AND message_id = $2 AND internal_date = $3
+	`
+
+	rows, err := db.Query(query, account, messageID, internalDate)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query: %s", err)
+	}
+
+	messages := []*DBMessage{}
+
+	for rows.Next() {
+		message := &DBMessage{}
+
+		err := rows.Scan(&message.ID, &message.Account, &message.MessageID,
+			&message.Subject, &message.FromAddresses, &message.InternalDate,
+			&message.CreateTime)
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("Unable to scan row: %s", err)
+		}
+
+		messages = append(messages, message)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Problem selecting from database: %s", err)
+	}
+
+	return messages, nil
+}
+
+// dbInsertMessage stores a message. body_preview and attachments are only
+// populated when --fetch-body is given; see postgresMigrations for the
+// imap_notify schema.
+func dbInsertMessage(db *sql.DB, message *Message) error {
+	query := `
+	INSERT INTO imap_notify
+	(account, message_id, subject, from_addresses, internal_date, body_preview, attachments)
+	VALUES($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	fromAddresses := strings.Join(message.From, ", ")
+
+	if message.Attachments == nil {
+		message.Attachments = []Attachment{}
+	}
+
+	attachments, err := json.Marshal(message.Attachments)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal attachments: %s", err)
+	}
+
+	_, err = db.Exec(query, message.Account, message.MessageID, message.Subject,
+		fromAddresses, message.InternalDate, message.BodyPreview, attachments)
+	if err != nil {
+		return fmt.Errorf("Unable to insert: %s", err)
+	}
+
+	return nil
+}
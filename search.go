@@ -0,0 +1,210 @@
+//
+// This file builds the IMAP SEARCH criteria used to avoid re-fetching the
+// whole mailbox on every run. By default we search for messages received
+// since the last successful run; --search lets a user substitute their own
+// criteria (e.g. "UNSEEN" or "FROM foo@bar"), and --full-resync falls back
+// to the original Fetch(1:*) behaviour.
+//
+// The default (non --search, non --full-resync) path relies on a
+// last-run timestamp, which is only available on Store backends that
+// implement sqlStore (postgres, sqlite); see imap_notify_last_run in
+// postgres_store.go and sqlite_store.go. Backends that don't implement it
+// (bolt) always fall back to a full fetch, same as --full-resync.
+//
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// searchDateFormat is the date format IMAP SEARCH expects for SINCE/BEFORE,
+// e.g. "02-Jan-2006".
+const searchDateFormat = "02-Jan-2006"
+
+// searchOverlap is subtracted from the last run time before building a
+// SINCE search, since IMAP SEARCH dates have day granularity. Re-fetching
+// one to two days of overlap is harmless: storeAndReportMessages already skips
+// anything already in the database.
+const searchOverlap = 24 * time.Hour
+
+// searchUIDs figures out which UIDs to fetch for this run, returning
+// useSearch = false when the caller should fall back to the original
+// Fetch(1:*) behaviour (full resync, or first run with nothing to compare
+// against).
+func searchUIDs(store Store, c *client.Client, host, user, mailbox, search string,
+	fullResync, verbose bool) ([]uint32, bool, error) {
+
+	if fullResync {
+		return nil, false, nil
+	}
+
+	var criteria *imap.SearchCriteria
+
+	if len(search) > 0 {
+		parsed, err := parseSearchCriteria(search)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to parse --search: %s", err)
+		}
+		criteria = parsed
+	} else {
+		lastRun, err := getLastRun(store, host, user, mailbox)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to retrieve last run time: %s", err)
+		}
+
+		if lastRun == nil {
+			if verbose {
+				log.Printf("No previous run found, doing a full fetch.")
+			}
+			return nil, false, nil
+		}
+
+		criteria = &imap.SearchCriteria{
+			Since:        lastRun.Add(-searchOverlap),
+			WithoutFlags: []string{imap.DeletedFlag},
+		}
+	}
+
+	if verbose {
+		log.Printf("Searching with criteria: %+v", criteria)
+	}
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to search: %s", err)
+	}
+
+	return uids, true, nil
+}
+
+// parseSearchCriteria turns a small subset of IMAP SEARCH syntax into an
+// imap.SearchCriteria: UNSEEN, SEEN, DELETED, "NOT DELETED", "FROM <addr>",
+// "SUBJECT <text>", and "SINCE <dd-Mon-yyyy>". It isn't a full RFC 3501
+// parser; it covers the criteria people actually reach for when narrowing a
+// spam folder.
+func parseSearchCriteria(raw string) (*imap.SearchCriteria, error) {
+	tokens := strings.Fields(raw)
+	criteria := &imap.SearchCriteria{}
+
+	for i := 0; i < len(tokens); i++ {
+		token := strings.ToUpper(tokens[i])
+
+		switch token {
+		case "UNSEEN":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+
+		case "SEEN":
+			criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+
+		case "DELETED":
+			criteria.WithFlags = append(criteria.WithFlags, imap.DeletedFlag)
+
+		case "NOT":
+			if i+1 >= len(tokens) || strings.ToUpper(tokens[i+1]) != "DELETED" {
+				return nil, fmt.Errorf("NOT is only supported as \"NOT DELETED\"")
+			}
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.DeletedFlag)
+			i++
+
+		case "FROM":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("FROM requires an address")
+			}
+			if criteria.Header == nil {
+				criteria.Header = textproto.MIMEHeader{}
+			}
+			criteria.Header.Add("From", tokens[i+1])
+			i++
+
+		case "SUBJECT":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("SUBJECT requires text")
+			}
+			if criteria.Header == nil {
+				criteria.Header = textproto.MIMEHeader{}
+			}
+			criteria.Header.Add("Subject", tokens[i+1])
+			i++
+
+		case "SINCE":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("SINCE requires a date (%s)", searchDateFormat)
+			}
+			since, err := time.Parse(searchDateFormat, tokens[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid SINCE date: %s", err)
+			}
+			criteria.Since = since
+			i++
+
+		default:
+			return nil, fmt.Errorf("Unsupported search token: %s", tokens[i])
+		}
+	}
+
+	return criteria, nil
+}
+
+// getLastRun returns the last time this mailbox was fetched, or nil if
+// store doesn't support it (in which case the caller should do a full
+// fetch) or there's no prior run recorded.
+func getLastRun(store Store, host, user, mailbox string) (*time.Time, error) {
+	sqlStore, ok := store.(sqlStore)
+	if !ok {
+		return nil, nil
+	}
+
+	query := fmt.Sprintf(`
+	SELECT last_run_at
+	FROM imap_notify_last_run
+	WHERE host = %s AND "user" = %s AND mailbox = %s
+	`, sqlStore.Placeholder(1), sqlStore.Placeholder(2), sqlStore.Placeholder(3))
+
+	row := sqlStore.DB().QueryRow(query, host, user, mailbox)
+
+	var lastRunAt time.Time
+	err := row.Scan(&lastRunAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query: %s", err)
+	}
+
+	return &lastRunAt, nil
+}
+
+// setLastRun records that this mailbox was just fetched. It's a no-op on
+// Store backends that don't support it (see getLastRun).
+func setLastRun(store Store, host, user, mailbox string) error {
+	sqlStore, ok := store.(sqlStore)
+	if !ok {
+		return nil
+	}
+
+	// Bind last_run_at twice (insert and update arms) rather than reusing a
+	// single placeholder, since sqlite's "?" placeholders are positional and
+	// don't support postgres's "$4 reused" style.
+	query := fmt.Sprintf(`
+	INSERT INTO imap_notify_last_run (host, "user", mailbox, last_run_at)
+	VALUES (%s, %s, %s, %s)
+	ON CONFLICT (host, "user", mailbox) DO UPDATE SET last_run_at = %s
+	`, sqlStore.Placeholder(1), sqlStore.Placeholder(2), sqlStore.Placeholder(3),
+		sqlStore.Placeholder(4), sqlStore.Placeholder(5))
+
+	now := time.Now()
+	_, err := sqlStore.DB().Exec(query, host, user, mailbox, now, now)
+	if err != nil {
+		return fmt.Errorf("Unable to upsert last run time: %s", err)
+	}
+
+	return nil
+}
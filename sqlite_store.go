@@ -0,0 +1,145 @@
+//
+// This file is the sqlite Store backend, for single-user installs that
+// don't want to stand up a full Postgres server. Its schema is created and
+// migrated by the binary itself on open, same as postgres; see
+// runMigrations.
+//
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS imap_notify (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		account        TEXT NOT NULL DEFAULT '',
+		message_id     TEXT NOT NULL,
+		subject        TEXT NOT NULL DEFAULT '',
+		from_addresses TEXT NOT NULL DEFAULT '',
+		internal_date  DATETIME NOT NULL,
+		create_time    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		body_preview   TEXT NOT NULL DEFAULT '',
+		attachments    TEXT NOT NULL DEFAULT '[]'
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS imap_notify_account_message_id_internal_date
+		ON imap_notify (account, message_id, internal_date)`,
+	`CREATE TABLE IF NOT EXISTS imap_notify_mailbox_state (
+		host         TEXT NOT NULL,
+		user         TEXT NOT NULL,
+		mailbox      TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		uid_next     INTEGER NOT NULL,
+		update_time  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (host, user, mailbox)
+	)`,
+	`CREATE TABLE IF NOT EXISTS imap_notify_last_run (
+		host        TEXT NOT NULL,
+		user        TEXT NOT NULL,
+		mailbox     TEXT NOT NULL,
+		last_run_at DATETIME NOT NULL,
+		PRIMARY KEY (host, user, mailbox)
+	)`,
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (Store, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("sqlite --store DSN must include a path, e.g. sqlite:///path/to/db.sqlite")
+	}
+
+	// busy_timeout lets a writer wait instead of failing immediately with
+	// "database is locked" when another account's goroutine is writing at
+	// the same time (the worker pool run by --config opens one sqliteStore
+	// shared across all accounts).
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open sqlite database: %s", err)
+	}
+
+	if err := runMigrations(db, sqliteMigrations, "?"); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("Unable to migrate sqlite database: %s", err)
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) DB() *sql.DB {
+	return s.db
+}
+
+// Placeholder implements sqlStore. modernc.org/sqlite binds positionally by
+// "?", unlike postgres's named "$N".
+func (s *sqliteStore) Placeholder(n int) string {
+	return "?"
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) Seen(account, messageID string,
+	internalDate time.Time) (bool, error) {
+
+	query := `
+	SELECT count(*)
+	FROM imap_notify
+	WHERE account = ? AND message_id = ? AND internal_date = ?
+	`
+
+	var count int
+	err := s.db.QueryRow(query, account, messageID, internalDate).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("Unable to query: %s", err)
+	}
+
+	return count > 0, nil
+}
+
+func (s *sqliteStore) Record(message *Message) error {
+	query := `
+	INSERT INTO imap_notify
+	(account, message_id, subject, from_addresses, internal_date, body_preview, attachments)
+	VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+
+	fromAddresses := strings.Join(message.From, ", ")
+
+	if message.Attachments == nil {
+		message.Attachments = []Attachment{}
+	}
+
+	attachments, err := json.Marshal(message.Attachments)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal attachments: %s", err)
+	}
+
+	_, err = s.db.Exec(query, message.Account, message.MessageID, message.Subject,
+		fromAddresses, message.InternalDate, message.BodyPreview, attachments)
+	if err != nil {
+		return fmt.Errorf("Unable to insert: %s", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Prune(olderThan time.Duration) error {
+	query := `DELETE FROM imap_notify WHERE create_time < ?`
+
+	_, err := s.db.Exec(query, time.Now().Add(-olderThan))
+	if err != nil {
+		return fmt.Errorf("Unable to prune: %s", err)
+	}
+
+	return nil
+}
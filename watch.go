@@ -0,0 +1,347 @@
+//
+// This file implements --watch mode: rather than doing a single
+// connect/fetch/logout cycle, we hold the connection open and use IMAP IDLE
+// to learn about new messages as they arrive. State (UIDVALIDITY/UIDNEXT) is
+// persisted per host/user/mailbox so that a restart resumes where it left
+// off instead of re-fetching the whole mailbox.
+//
+// Mailbox state (UIDVALIDITY/UIDNEXT) is only persisted on Store backends
+// that implement sqlStore (postgres, sqlite); see imap_notify_mailbox_state
+// in postgres_store.go and sqlite_store.go. On backends that don't (bolt),
+// every (re)connect and every mailbox update seen while IDLEing resyncs the
+// mailbox from UID 1.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/idle"
+)
+
+// idleRestartInterval is how long we hold a single IDLE command open before
+// re-issuing it. RFC 2177 recommends not waiting longer than 29 minutes.
+const idleRestartInterval = 27 * time.Minute
+
+// MailboxState holds the last seen UIDVALIDITY/UIDNEXT for a mailbox so we
+// can resume incrementally rather than re-fetching everything.
+type MailboxState struct {
+	Host        string
+	User        string
+	Mailbox     string
+	UIDValidity uint32
+	UIDNext     uint32
+}
+
+// watchMailbox runs forever (until SIGINT/SIGTERM), reconnecting with
+// exponential backoff whenever the connection is lost.
+func watchMailbox(job *Job, pass string, args *Args, store Store, notifier Notifier) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	backoff := time.Second
+
+	for {
+		select {
+		case <-stop:
+			log.Printf("Received shutdown signal, exiting.")
+			return nil
+		default:
+		}
+
+		err := watchOnce(job, pass, args, store, notifier, stop)
+		if err == nil {
+			// watchOnce only returns nil on a clean shutdown.
+			return nil
+		}
+
+		log.Printf("Watch session ended: %s. Reconnecting in %s.", err, backoff)
+
+		select {
+		case <-stop:
+			log.Printf("Received shutdown signal, exiting.")
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+		// Add a little jitter so we don't hammer the server in lockstep with
+		// any other client reconnecting at the same time.
+		backoff += time.Duration(rand.Int63n(int64(time.Second)))
+	}
+}
+
+// watchOnce connects, resyncs, and then IDLEs until the connection drops or
+// stop is signalled. A nil error means we were asked to shut down cleanly;
+// any other error means the caller should reconnect.
+func watchOnce(job *Job, pass string, args *Args, store Store, notifier Notifier,
+	stop <-chan os.Signal) error {
+
+	address := fmt.Sprintf("%s:%d", job.Host, job.Port)
+
+	if args.Verbose {
+		log.Printf("Connecting to %s...", address)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	c, err := client.DialWithDialerTLS(dialer, address, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to IMAP server: %s", err)
+	}
+	defer func() {
+		_ = c.Logout()
+	}()
+
+	if err := c.Login(job.User, pass); err != nil {
+		return fmt.Errorf("Unable to login to IMAP: %s", err)
+	}
+
+	mbox, err := c.Select(job.Mailbox, true)
+	if err != nil {
+		return fmt.Errorf("Unable to select mailbox: %s: %s", job.Mailbox, err)
+	}
+
+	state, err := getMailboxState(store, job.Host, job.User, job.Mailbox)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve mailbox state: %s", err)
+	}
+
+	var fromUID uint32 = 1
+	if state != nil && state.UIDValidity == mbox.UidValidity {
+		fromUID = state.UIDNext
+	} else if state != nil && args.Verbose {
+		log.Printf("UIDVALIDITY changed (%d -> %d), resyncing mailbox.",
+			state.UIDValidity, mbox.UidValidity)
+	}
+
+	if err := fetchAndStoreNewUIDs(c, store, job, notifier, args.Verbose, mbox.UidValidity, fromUID); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		updates := make(chan client.Update, 1)
+		c.Updates = updates
+
+		idleClient := idle.NewClient(c)
+
+		idleDone := make(chan error, 1)
+		stopIdle := make(chan struct{})
+		go func() {
+			idleDone <- idleClient.IdleWithFallback(stopIdle, idleRestartInterval)
+		}()
+
+		sawUpdate := false
+	waitLoop:
+		for {
+			select {
+			case <-stop:
+				close(stopIdle)
+				drainUntilIdleDone(updates, idleDone)
+				return nil
+
+			case update := <-updates:
+				switch update.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate:
+					sawUpdate = true
+					close(stopIdle)
+					if err := drainUntilIdleDone(updates, idleDone); err != nil {
+						return fmt.Errorf("IDLE failed: %s", err)
+					}
+					break waitLoop
+				}
+
+			case err := <-idleDone:
+				if err != nil {
+					return fmt.Errorf("IDLE failed: %s", err)
+				}
+				break waitLoop
+			}
+		}
+
+		c.Updates = nil
+
+		if sawUpdate {
+			mbox, err := c.Select(job.Mailbox, true)
+			if err != nil {
+				return fmt.Errorf("Unable to reselect mailbox: %s: %s",
+					job.Mailbox, err)
+			}
+
+			state, err := getMailboxState(store, job.Host, job.User, job.Mailbox)
+			if err != nil {
+				return fmt.Errorf("Unable to retrieve mailbox state: %s", err)
+			}
+
+			fromUID := uint32(1)
+			if state != nil && state.UIDValidity == mbox.UidValidity {
+				fromUID = state.UIDNext
+			}
+
+			if err := fetchAndStoreNewUIDs(c, store, job, notifier, args.Verbose, mbox.UidValidity, fromUID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// drainUntilIdleDone keeps reading from updates, discarding them, until
+// idleDone fires. Needed after close(stopIdle): IdleWithFallback keeps
+// dispatching untagged updates while it winds down, and updates is only
+// buffered 1, so a caller that stops reading it can deadlock waiting on
+// idleDone.
+func drainUntilIdleDone(updates chan client.Update, idleDone chan error) error {
+	for {
+		select {
+		case <-updates:
+		case err := <-idleDone:
+			return err
+		}
+	}
+}
+
+// fetchAndStoreNewUIDs fetches UIDs >= fromUID, stores/reports any new
+// messages, and advances the persisted mailbox state to one past the highest
+// UID fetched (or leaves it at fromUID if nothing newer was fetched).
+func fetchAndStoreNewUIDs(c *client.Client, store Store, job *Job,
+	notifier Notifier, verbose bool, uidValidity, fromUID uint32) error {
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(fromUID, 0)
+
+	imapMessages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []string{imap.EnvelopeMsgAttr,
+			imap.InternalDateMsgAttr, imap.UidMsgAttr}, imapMessages)
+	}()
+
+	messages := []*Message{}
+	var maxUID uint32
+
+	for msg := range imapMessages {
+		if msg.Uid >= maxUID {
+			maxUID = msg.Uid
+		}
+
+		message := &Message{
+			Account:      job.Account,
+			MessageID:    msg.Envelope.MessageId,
+			Subject:      msg.Envelope.Subject,
+			From:         []string{},
+			InternalDate: msg.InternalDate,
+		}
+
+		for _, address := range msg.Envelope.From {
+			message.From = append(message.From, fmt.Sprintf("%s <%s@%s>",
+				address.PersonalName, address.MailboxName, address.HostName))
+		}
+
+		messages = append(messages, message)
+	}
+
+	if err := <-done; err != nil {
+		return fmt.Errorf("Problem fetching messages: %s", err)
+	}
+
+	if err := storeAndReportMessages(store, messages, notifier, verbose); err != nil {
+		return fmt.Errorf("Unable to report messages: %s", err)
+	}
+
+	uidNext := fromUID
+	if maxUID+1 > uidNext {
+		uidNext = maxUID + 1
+	}
+
+	state := &MailboxState{
+		Host:        job.Host,
+		User:        job.User,
+		Mailbox:     job.Mailbox,
+		UIDValidity: uidValidity,
+		UIDNext:     uidNext,
+	}
+
+	if err := setMailboxState(store, state); err != nil {
+		return fmt.Errorf("Unable to persist mailbox state: %s", err)
+	}
+
+	return nil
+}
+
+// getMailboxState returns nil, nil if store doesn't support sqlStore, which
+// tells the caller to resync from UID 1 rather than error out.
+func getMailboxState(store Store, host, user, mailbox string) (*MailboxState, error) {
+	sqlStore, ok := store.(sqlStore)
+	if !ok {
+		return nil, nil
+	}
+
+	query := fmt.Sprintf(`
+	SELECT host, "user", mailbox, uid_validity, uid_next
+	FROM imap_notify_mailbox_state
+	WHERE host = %s AND "user" = %s AND mailbox = %s
+	`, sqlStore.Placeholder(1), sqlStore.Placeholder(2), sqlStore.Placeholder(3))
+
+	row := sqlStore.DB().QueryRow(query, host, user, mailbox)
+
+	state := &MailboxState{}
+	err := row.Scan(&state.Host, &state.User, &state.Mailbox,
+		&state.UIDValidity, &state.UIDNext)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query: %s", err)
+	}
+
+	return state, nil
+}
+
+// setMailboxState is a no-op on Store backends that don't support sqlStore
+// (see getMailboxState).
+func setMailboxState(store Store, state *MailboxState) error {
+	sqlStore, ok := store.(sqlStore)
+	if !ok {
+		return nil
+	}
+
+	// Bind uid_validity/uid_next/update_time twice (insert and update arms)
+	// rather than reusing a placeholder, since sqlite's "?" placeholders are
+	// positional and don't support postgres's "$4 reused" style.
+	query := fmt.Sprintf(`
+	INSERT INTO imap_notify_mailbox_state
+	(host, "user", mailbox, uid_validity, uid_next, update_time)
+	VALUES (%s, %s, %s, %s, %s, %s)
+	ON CONFLICT (host, "user", mailbox) DO UPDATE
+	SET uid_validity = %s, uid_next = %s, update_time = %s
+	`, sqlStore.Placeholder(1), sqlStore.Placeholder(2), sqlStore.Placeholder(3),
+		sqlStore.Placeholder(4), sqlStore.Placeholder(5), sqlStore.Placeholder(6),
+		sqlStore.Placeholder(7), sqlStore.Placeholder(8), sqlStore.Placeholder(9))
+
+	now := time.Now()
+	_, err := sqlStore.DB().Exec(query, state.Host, state.User, state.Mailbox,
+		state.UIDValidity, state.UIDNext, now,
+		state.UIDValidity, state.UIDNext, now)
+	if err != nil {
+		return fmt.Errorf("Unable to upsert mailbox state: %s", err)
+	}
+
+	return nil
+}